@@ -1,69 +1,618 @@
-// Print a random selection of lines from a file, in the original order.  Reads from stdin, writes
-// to stdout.
+// Print a random selection of lines from a file, in the original order or, with -shuffle, in
+// random order (all lines if no count is given, like shuf).  Reads the files named on the command
+// line ("-" is stdin), or stdin if there are none, and writes to stdout.  The inputs are sampled as
+// one concatenated population unless -per-file is given, in which case each is sampled separately
+// (and each has its own -header lines).
 //
-// This is not intended to be clever.  Extremely Huge (tm) files may defeat it.
+// With -strata or -strata-regex the lines are grouped by a key and -n, -atleast and -pct apply to
+// each group separately.  The -pct count is rounded up in each group, so that every group is
+// represented.
+//
+// With -p each line is selected independently with the given probability as it is read, so the
+// output keeps pace with the input and no memory is needed.
+//
+// With -hash-pct a line is selected iff a hash of the line (or of one of its columns) and a salt
+// falls below a threshold.  This is not random at all but gives the same selection for the same
+// lines across runs and files, and it needs no memory.
+//
+// With -skip-blank and -skip-comments, blank lines and comment lines are not part of the population
+// and are dropped, or printed unchanged in their original positions with -pass-skipped.
+//
+// Line numbers for -numbers and -only-numbers are 1-based and count the lines of the concatenated
+// inputs, or of each input with -per-file, including header and skipped lines.
+//
+// With -paragraph or -0 the unit of sampling is a blank-line-separated paragraph or a NUL-terminated
+// record instead of a line, and everything said about lines applies to those records.
+//
+// This is not intended to be clever.  Extremely Huge (tm) files may defeat it, unless -stream is
+// used, in which case only the selected lines are kept in memory.
 
 package main
 
 import (
 	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
 	"flag"
 	"fmt"
+	"io"
+	"math"
 	"math/rand"
 	"os"
+	"regexp"
 	"sort"
+	"strconv"
+	"strings"
 )
 
 var (
 	atLeast = flag.Uint("atleast", 0, "Print at least this many lines (up to file length)")
 	pct = flag.Float64("pct", 0, "Print this percentage of lines")
+	count = flag.Uint("n", 0, "Print exactly this many lines (up to file length); excludes -atleast and -pct")
+	stream = flag.Bool("stream", false, "Reservoir-sample -n lines without buffering the input")
+	weightCol = flag.Uint("weight", 0, "Select lines with probability proportional to the number in this column (1-based)")
+	strataCol = flag.Uint("strata", 0, "Sample separately within groups of lines having the same value in this column (1-based); -pct rounds up per group")
+	strataRe = flag.String("strata-regex", "", "Sample separately within groups of lines having the same match for this regexp (its first group, if any); -pct rounds up per group")
+	prob = flag.Float64("p", 0, "Print each line independently with this probability, as it is read")
+	hashPct = flag.Float64("hash-pct", 0, "Print the lines whose hash falls in this percentage of the hash space")
+	hashCol = flag.Uint("hash-column", 0, "Hash only this column (1-based) for -hash-pct, not the whole line")
+	salt = flag.String("salt", "", "Salt for the -hash-pct hash")
+	delim = flag.String("delim", "", "Column delimiter for -weight, -strata and -hash-column (default whitespace)")
+	perFile = flag.Bool("per-file", false, "Sample each input file separately instead of their concatenation")
+	paragraph = flag.Bool("paragraph", false, "Sample blank-line-separated paragraphs instead of lines")
+	nul = flag.Bool("0", false, "Sample NUL-terminated records instead of lines")
+	restName = flag.String("rest", "", "Write the lines that were not selected to this `file`, in the original order")
+	withReplacement = flag.Bool("with-replacement", false, "Draw the -n lines independently, allowing duplicates and more lines than the input (bootstrap)")
+	skipBlank = flag.Bool("skip-blank", false, "Exclude blank lines from the population")
+	skipComments = flag.Bool("skip-comments", false, "Exclude lines matching -comment from the population")
+	commentRe = flag.String("comment", `^\s*#`, "Regexp matching comment lines for -skip-comments")
+	passSkipped = flag.Bool("pass-skipped", false, "Print the lines excluded by -skip-blank and -skip-comments unchanged, in place")
+	numbers = flag.Bool("numbers", false, "Prefix each sampled line, in both outputs, with its line number in the input and a tab")
+	onlyNumbers = flag.Bool("only-numbers", false, "Print only the line numbers of the selected lines")
+	shuffle = flag.Bool("shuffle", false, "Print the selected lines in random order; without -n, -atleast or -pct, select all lines")
+	seed = flag.Int64("seed", 0, "Seed the random number generator, for reproducible selections (0 = random)")
+)
+
+var header headerCount
+
+func init() {
+	flag.Var(&header, "header", "Always print the first `N` lines unchanged, outside the sample (-header alone means 1)")
+}
+
+var (
+	rng           *rand.Rand
+	restOut       *os.File
+	strataRegexp  *regexp.Regexp
+	commentRegexp *regexp.Regexp
 )
 
 func main() {
 	flag.Parse()
-	if *atLeast == 0 && *pct == 0 {
-		fmt.Fprintln(os.Stderr, "At least one of -atleast and -pct is required.\n")
-		flag.Usage()
+	if *hashPct != 0 || *prob != 0 {
+		if *hashPct != 0 && *prob != 0 {
+			fmt.Fprintln(os.Stderr, "-hash-pct can't be combined with -p")
+			os.Exit(2)
+		}
+		if *count != 0 || *atLeast != 0 || *pct != 0 || *stream || *weightCol != 0 || *strataCol != 0 || *strataRe != "" || *shuffle {
+			fmt.Fprintln(os.Stderr, "-hash-pct and -p can't be combined with -n, -atleast, -pct, -stream, -weight, -strata or -shuffle")
+			os.Exit(2)
+		}
+		if *hashPct < 0 || *hashPct > 100 {
+			fmt.Fprintln(os.Stderr, "Percentage out of range")
+			os.Exit(2)
+		}
+		if *prob < 0 || *prob > 1 {
+			fmt.Fprintln(os.Stderr, "Probability out of range")
+			os.Exit(2)
+		}
+	} else if *count == 0 && *atLeast == 0 && *pct == 0 {
+		if !*shuffle || *stream {
+			fmt.Fprint(os.Stderr, "One of -n, -p or -hash-pct, or at least one of -atleast and -pct, is required.\n\n")
+			flag.Usage()
+			os.Exit(2)
+		}
+		*pct = 100
+	}
+	if *withReplacement && (*count == 0 || *stream || *weightCol != 0) {
+		fmt.Fprintln(os.Stderr, "-with-replacement requires -n and can't be combined with -stream or -weight")
 		os.Exit(2)
 	}
+	if *count != 0 {
+		if *atLeast != 0 || *pct != 0 {
+			fmt.Fprintln(os.Stderr, "-n can't be combined with -atleast or -pct")
+			os.Exit(2)
+		}
+		// "Exactly n" is "at least n" with no percentage to push the count higher.
+		*atLeast = *count
+	}
 	if *pct < 0 || *pct > 100 {
 		fmt.Fprintln(os.Stderr, "Percentage out of range")
 		os.Exit(2)
 	}
+	if *paragraph && *nul {
+		fmt.Fprintln(os.Stderr, "-paragraph can't be combined with -0")
+		os.Exit(2)
+	}
+	if *seed == 0 {
+		*seed = rand.Int63()
+	}
+	rng = rand.New(rand.NewSource(*seed))
+	if *stream {
+		if *pct != 0 {
+			fmt.Fprintln(os.Stderr, "-pct can't be used with -stream")
+			os.Exit(2)
+		}
+		if *weightCol != 0 {
+			fmt.Fprintln(os.Stderr, "-weight can't be used with -stream")
+			os.Exit(2)
+		}
+		if *restName != "" {
+			fmt.Fprintln(os.Stderr, "-rest can't be used with -stream")
+			os.Exit(2)
+		}
+		if *strataCol != 0 || *strataRe != "" {
+			fmt.Fprintln(os.Stderr, "-strata and -strata-regex can't be used with -stream")
+			os.Exit(2)
+		}
+		if *passSkipped {
+			fmt.Fprintln(os.Stderr, "-pass-skipped can't be used with -stream")
+			os.Exit(2)
+		}
+	}
+	if *passSkipped && *shuffle {
+		fmt.Fprintln(os.Stderr, "-pass-skipped can't be combined with -shuffle")
+		os.Exit(2)
+	}
+	if *skipComments {
+		var err error
+		commentRegexp, err = regexp.Compile(*commentRe)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -comment", err)
+			os.Exit(2)
+		}
+	}
+	if *strataRe != "" {
+		if *strataCol != 0 {
+			fmt.Fprintln(os.Stderr, "-strata can't be combined with -strata-regex")
+			os.Exit(2)
+		}
+		var err error
+		strataRegexp, err = regexp.Compile(*strataRe)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Invalid -strata-regex", err)
+			os.Exit(2)
+		}
+	}
+	if *restName != "" {
+		var err error
+		restOut, err = os.Create(*restName)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Can't create output", err)
+			os.Exit(1)
+		}
+		defer restOut.Close()
+	}
 
-	scanner := bufio.NewScanner(os.Stdin)
-	ls := make([]string, 0, 1000)
-	for scanner.Scan() {
-		ls = append(ls, scanner.Text())
+	inputs := flag.Args()
+	if len(inputs) == 0 {
+		inputs = []string{"-"}
 	}
-	if err := scanner.Err(); err != nil {
-		fmt.Fprintln(os.Stderr, "Scanner failed", err)
-		os.Exit(1)
+	if *perFile {
+		for _, name := range inputs {
+			sample([]string{name})
+		}
+	} else {
+		sample(inputs)
 	}
-	*atLeast = min(*atLeast, uint(len(ls)))
+}
 
-	// Number of selections
-	toPick := max(int(*atLeast), min(int(float64(len(ls))*(*pct)/100), len(ls)))
-	if toPick == 0 {
+// Sample the concatenation of the named inputs and print the selection.
+func sample(names []string) {
+	if *stream {
+		reservoir(names, int(min(*atLeast, math.MaxInt)))
+		return
+	}
+	if *hashPct != 0 {
+		filter(names, hashSelected)
 		return
 	}
+	if *prob != 0 {
+		filter(names, func(int, string) bool { return rng.Float64() < *prob })
+		return
+	}
+
+	ls := make([]string, 0, 1000)
+	readRecords(names, func(l string) {
+		ls = append(ls, l)
+	})
+
+	// Header lines and skipped lines are not part of the population
+	nh := min(int(header), len(ls))
 
-	// Bag of candidates, indices into `ls`
-	cand := make([]int, len(ls))
-	for i := 0 ; i < len(cand); i++ {
-		cand[i] = i
+	var sel []int
+	if *strataCol != 0 || strataRegexp != nil {
+		// Bags of candidates by stratum, strata in order of first appearance so that the selection
+		// is reproducible with -seed
+		strata := make(map[string][]int)
+		keys := make([]string, 0)
+		for i := nh; i < len(ls); i++ {
+			if skipped(ls[i]) {
+				continue
+			}
+			key := stratum(ls[i])
+			if _, found := strata[key]; !found {
+				keys = append(keys, key)
+			}
+			strata[key] = append(strata[key], i)
+		}
+		for _, key := range keys {
+			sel = append(sel, choose(ls, strata[key])...)
+		}
+	} else {
+		// Bag of candidates, indices into `ls`
+		cand := make([]int, 0, len(ls)-nh)
+		for i := nh; i < len(ls); i++ {
+			if !skipped(ls[i]) {
+				cand = append(cand, i)
+			}
+		}
+		sel = choose(ls, cand)
 	}
+	sort.Sort(sort.IntSlice(sel))
 
-	// Permute the candidates
-	for i := 0 ; i < len(cand) ; i++ {
-		r := rand.Intn(len(cand))
-		cand[i], cand[r] = cand[r], cand[i]
+	// Print everything in the original order: the selection to stdout, the rest of the population
+	// to -rest, and header lines and passed-through skipped lines to both.  With -shuffle, the
+	// selection is printed in random order right after the header instead.
+	j := 0
+	for i, l := range ls {
+		if i == nh && *shuffle {
+			out := append([]int(nil), sel...)
+			rng.Shuffle(len(out), func(i, j int) { out[i], out[j] = out[j], out[i] })
+			for _, k := range out {
+				emit(os.Stdout, k, ls[k])
+			}
+		}
+		selected := false
+		for j < len(sel) && sel[j] == i {
+			if !*shuffle {
+				emit(os.Stdout, i, l)
+			}
+			j++
+			selected = true
+		}
+		switch {
+		case selected:
+		case i < nh || skipped(l):
+			if i < nh || *passSkipped {
+				emit(os.Stdout, -1, l)
+				if restOut != nil {
+					emit(restOut, -1, l)
+				}
+			}
+		case restOut != nil:
+			emit(restOut, i, l)
+		}
 	}
+}
 
-	// Print the prefix of the permutation in the original order
-	sel := cand[:toPick]
-	sort.Sort(sort.IntSlice(sel))
-	for _, k := range sel {
-		fmt.Println(ls[k])
+// Select from the candidates, which are indices into ls, as many as -n, -atleast and -pct ask for.
+// The candidates are reordered in the process and the result is a prefix of cand, except with
+// -with-replacement, when it is a fresh slice of -n independent draws.
+func choose(ls []string, cand []int) []int {
+	if *withReplacement {
+		if len(cand) == 0 {
+			return nil
+		}
+		sel := make([]int, *count)
+		for i := range sel {
+			sel[i] = cand[rng.Intn(len(cand))]
+		}
+		return sel
+	}
+
+	// Within a stratum the percentage is rounded up, so that small strata are not left out entirely
+	byPct := float64(len(cand)) * (*pct) / 100
+	if *strataCol != 0 || strataRegexp != nil {
+		byPct = math.Ceil(byPct)
+	}
+	toPick := max(int(min(*atLeast, uint(len(cand)))), min(int(byPct), len(cand)))
+
+	// Permute the candidates, or with -weight order them so that any prefix is a weighted sample
+	if *weightCol != 0 {
+		toPick = weightedOrder(ls, cand, toPick)
+	} else {
+		for i := 0 ; i < len(cand) ; i++ {
+			r := rng.Intn(len(cand))
+			cand[i], cand[r] = cand[r], cand[i]
+		}
+	}
+	return cand[:toPick]
+}
+
+// The grouping key of l for -strata and -strata-regex.  Lines without the column, or not matching
+// the regexp, all go in the group with the empty key.
+func stratum(l string) string {
+	if strataRegexp != nil {
+		m := strataRegexp.FindStringSubmatch(l)
+		switch {
+		case m == nil:
+			return ""
+		case len(m) > 1:
+			return m[1]
+		default:
+			return m[0]
+		}
+	}
+	f, _ := column(l, *strataCol)
+	return f
+}
+
+// Sort the candidates by the Efraimidis-Spirakis key log(u)/w, largest first; a prefix of that order
+// is a weighted random sample without replacement.  Lines with zero weight are never selected, so
+// the returned count is toPick capped at the number of candidates with nonzero weight.
+func weightedOrder(ls []string, cand []int, toPick int) int {
+	type keyed struct {
+		index int
+		key   float64
+	}
+	keys := make([]keyed, len(cand))
+	nonzero := 0
+	for k, i := range cand {
+		w, err := lineWeight(ls[i])
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Line %d: %v\n", i+1, err)
+			os.Exit(1)
+		}
+		keys[k] = keyed{i, math.Inf(-1)}
+		if w > 0 {
+			keys[k].key = math.Log(rng.Float64()) / w
+			nonzero++
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].key > keys[j].key })
+	for k := range keys {
+		cand[k] = keys[k].index
+	}
+	return min(toPick, nonzero)
+}
+
+func lineWeight(l string) (float64, error) {
+	f, err := column(l, *weightCol)
+	if err != nil {
+		return 0, err
+	}
+	w, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+	if err != nil {
+		return 0, err
+	}
+	if w < 0 || math.IsNaN(w) || math.IsInf(w, 0) {
+		return 0, fmt.Errorf("Invalid weight %q", f)
+	}
+	return w, nil
+}
+
+// Extract the k'th (1-based) column of l, split by -delim or by whitespace.
+func column(l string, k uint) (string, error) {
+	var fields []string
+	if *delim == "" {
+		fields = strings.Fields(l)
+	} else {
+		fields = strings.Split(l, *delim)
+	}
+	if k > uint(len(fields)) {
+		return "", fmt.Errorf("No column %d", k)
+	}
+	return fields[k-1], nil
+}
+
+// Algorithm R: the first k lines of the population fill the reservoir, after that line i (0-based)
+// replaces a random slot with probability k/(i+1).  Line indices in the input are kept with the text
+// so that the selection can be printed in the original order.
+func reservoir(names []string, k int) {
+	type entry struct {
+		index int
+		text  string
+	}
+	res := make([]entry, 0)
+	n, i := 0, 0
+	readRecords(names, func(l string) {
+		switch {
+		case n < int(header):
+			emit(os.Stdout, -1, l)
+		case skipped(l):
+		case i < k:
+			res = append(res, entry{n, l})
+			i++
+		default:
+			if r := rng.Intn(i + 1); r < k {
+				res[r] = entry{n, l}
+			}
+			i++
+		}
+		n++
+	})
+
+	if *shuffle {
+		rng.Shuffle(len(res), func(i, j int) { res[i], res[j] = res[j], res[i] })
+	} else {
+		sort.Slice(res, func(i, j int) bool { return res[i].index < res[j].index })
+	}
+	for _, e := range res {
+		emit(os.Stdout, e.index, e.text)
+	}
+}
+
+// Print the lines for which selected returns true as they are read; the rest go to -rest, if given.
+// Header and skipped lines are not passed to selected, whose i is the index of l in the input.
+func filter(names []string, selected func(i int, l string) bool) {
+	i := 0
+	readRecords(names, func(l string) {
+		switch {
+		case i < int(header) || skipped(l):
+			if i < int(header) || *passSkipped {
+				emit(os.Stdout, -1, l)
+				if restOut != nil {
+					emit(restOut, -1, l)
+				}
+			}
+		case selected(i, l):
+			emit(os.Stdout, i, l)
+		case restOut != nil:
+			emit(restOut, i, l)
+		}
+		i++
+	})
+}
+
+// Selection predicate for -hash-pct.  The hash is the first 64 bits of the SHA-256 of the salt, a
+// NUL, and the key; the line is selected if the hash, as a fraction of the hash space, is below the
+// percentage.
+func hashSelected(i int, l string) bool {
+	key := l
+	if *hashCol != 0 {
+		var err error
+		key, err = column(l, *hashCol)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Line %d: %v\n", i+1, err)
+			os.Exit(1)
+		}
+	}
+	h := sha256.Sum256([]byte(*salt + "\x00" + key))
+	return float64(binary.BigEndian.Uint64(h[:8]))/math.MaxUint64 < *hashPct/100
+}
+
+// Paragraphs and NUL-terminated records can be much longer than lines, so they get a larger limit
+// than the scanner's default.
+const maxRecordSize = 1 << 30
+
+// Call f on each record of the named inputs in turn, "-" being stdin.
+func readRecords(names []string, f func(string)) {
+	for _, name := range names {
+		input := os.Stdin
+		if name != "-" {
+			var err error
+			input, err = os.Open(name)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "Can't open input", err)
+				os.Exit(1)
+			}
+		}
+		scanner := bufio.NewScanner(input)
+		switch {
+		case *paragraph:
+			scanner.Split(scanParagraphs)
+			scanner.Buffer(nil, maxRecordSize)
+		case *nul:
+			scanner.Split(scanNul)
+			scanner.Buffer(nil, maxRecordSize)
+		}
+		for scanner.Scan() {
+			f(scanner.Text())
+		}
+		if err := scanner.Err(); err != nil {
+			fmt.Fprintln(os.Stderr, "Scanner failed", err)
+			os.Exit(1)
+		}
+		if input != os.Stdin {
+			input.Close()
+		}
+	}
+}
+
+// Split function for -paragraph: records are separated by one or more blank lines, blank meaning
+// empty after trimming white space, as for -skip-blank.  start is the beginning of the paragraph and
+// end the end of its last nonblank line so far, or -1 before there is one.
+func scanParagraphs(data []byte, atEOF bool) (int, []byte, error) {
+	start, end := 0, -1
+	for pos := 0; pos < len(data); {
+		eol := bytes.IndexByte(data[pos:], '\n')
+		if eol < 0 {
+			if !atEOF {
+				break
+			}
+			eol = len(data) - pos
+		}
+		next := min(pos+eol+1, len(data))
+		if len(bytes.TrimSpace(data[pos:pos+eol])) == 0 {
+			if end >= 0 {
+				return next, data[start:end], nil
+			}
+			start = next
+		} else {
+			end = pos + eol
+		}
+		pos = next
+	}
+	if atEOF && end >= 0 {
+		return len(data), data[start:end], nil
+	}
+	return start, nil, nil
+}
+
+// Split function for -0: records are terminated by NUL, the last terminator being optional.
+func scanNul(data []byte, atEOF bool) (int, []byte, error) {
+	if i := bytes.IndexByte(data, 0); i >= 0 {
+		return i + 1, data[:i], nil
+	}
+	if atEOF && len(data) > 0 {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
+
+// Whether l is excluded from the population by -skip-blank or -skip-comments.
+func skipped(l string) bool {
+	return *skipBlank && strings.TrimSpace(l) == "" || commentRegexp != nil && commentRegexp.MatchString(l)
+}
+
+// Print a record with the terminator appropriate to the record kind, numbered as requested.  i is
+// the 0-based index of the record in the input, negative for header and skipped lines, which are
+// never numbered.
+func emit(w io.Writer, i int, text string) {
+	if *onlyNumbers {
+		if i >= 0 {
+			fmt.Fprintln(w, i+1)
+		}
+		return
+	}
+	if *numbers && i >= 0 {
+		text = strconv.Itoa(i+1) + "\t" + text
+	}
+	switch {
+	case *nul:
+		fmt.Fprint(w, text, "\x00")
+	case *paragraph:
+		fmt.Fprint(w, text, "\n\n")
+	default:
+		fmt.Fprintln(w, text)
+	}
+}
+
+// The value of -header, which may also be given as a bare -header meaning a single line.
+type headerCount uint
+
+func (h *headerCount) String() string {
+	return strconv.FormatUint(uint64(*h), 10)
+}
+
+func (h *headerCount) IsBoolFlag() bool {
+	return true
+}
+
+func (h *headerCount) Set(s string) error {
+	switch s {
+	case "true":
+		*h = 1
+	case "false":
+		*h = 0
+	default:
+		n, err := strconv.ParseUint(s, 10, 0)
+		if err != nil {
+			return err
+		}
+		// Capped so that int(header) is always valid; that many lines means all of them anyway
+		*h = headerCount(min(n, math.MaxInt))
 	}
+	return nil
 }